@@ -0,0 +1,200 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+
+	"github.com/rancherio/websocket-proxy/common"
+)
+
+// Handler processes backend-side messages for a single registered path
+// (e.g. "/v1/logs/"). incomingMessages delivers decoded frontend
+// payloads for one connection (messageKey); response is used to push
+// frames back to the proxy, including the final close signal via
+// SignalHandlerClosed.
+type Handler interface {
+	Handle(messageKey string, initialMessage string, incomingMessages <-chan string, response chan<- common.Message)
+}
+
+// getHandler finds the Handler registered for the longest path prefix
+// matching path. Registered paths are expected to end in "/"; a path
+// that exactly matches the prefix without the trailing slash also
+// matches (so both "/v1/stats" and "/v1/stats/1234" match "/v1/stats/").
+func getHandler(path string, handlers map[string]Handler) (Handler, bool) {
+	_, h, ok := getHandlerWithPrefix(path, handlers)
+	return h, ok
+}
+
+// getHandlerWithPrefix is getHandler, but also returns the registered
+// prefix key that matched - needed by HandlerRegistry.Get to look up
+// the HandlerOptions tied to that exact registration rather than
+// re-matching by Handler identity.
+func getHandlerWithPrefix(path string, handlers map[string]Handler) (prefix string, h Handler, found bool) {
+	for p, candidate := range handlers {
+		if path != strings.TrimSuffix(p, "/") && !strings.HasPrefix(path, p) {
+			continue
+		}
+		if !found || len(p) > len(prefix) {
+			prefix, h, found = p, candidate, true
+		}
+	}
+	return prefix, h, found
+}
+
+// SignalHandlerClosed notifies the proxy that the handler for key is
+// done sending messages, so it can tear down the corresponding
+// frontend connection.
+func SignalHandlerClosed(key string, response chan<- common.Message) {
+	response <- common.Message{
+		Key:  key,
+		Type: common.Close,
+	}
+}
+
+// connection tracks the state connectToProxyWS keeps per messageKey:
+// the channel messages are delivered to the Handler on. A key's Handler
+// has been started exactly when the key has an entry in the conns map.
+type connection struct {
+	incomingMessages chan string
+}
+
+// connectToProxyWS is the backend's main loop once it has dialed the
+// proxy's backend endpoint, for callers that only have a bare
+// map[string]Handler. It wraps handlers in a HandlerRegistry with
+// zero-value HandlerOptions for every path - callers that need to
+// advertise a real Version/Subprotocols/Codec must build their own
+// *HandlerRegistry and call ConnectToProxyWS directly. Idle detection
+// and ping/pong keepalive use DefaultKeepaliveConfig; use
+// ConnectToProxyWS to customize it.
+func connectToProxyWS(ws *websocket.Conn, handlers map[string]Handler) {
+	registry := NewHandlerRegistry()
+	for path, h := range handlers {
+		registry.Register(path, h, HandlerOptions{})
+	}
+	ConnectToProxyWS(ws, registry, DefaultKeepaliveConfig, nil)
+}
+
+// ConnectToProxyWS is the backend's main loop once it has dialed the
+// proxy's backend endpoint. It sends a Hello frame built from registry
+// (advertising every registered path's real capabilities, not a
+// zero-value placeholder), then reads frames off ws, demultiplexes them
+// by Key, and dispatches each to the Handler that registry.Get resolves
+// for the frame's path - so capability lookups (HandlerOptions) are
+// actually consulted on the live dispatch path rather than a parallel
+// struct nothing reads.
+//
+// NOTE: Version/Subprotocols aren't used to reject anything here,
+// and Codec doesn't change how msg.Body is (de)serialized - there's no
+// proxy-side peer in this checkout to negotiate with, and Message
+// envelopes are always JSON regardless of a handler's declared Codec.
+// Wiring those through requires the proxy package, which isn't part of
+// this tree.
+//
+// stats, if non-nil, is updated in place (via the atomic package) for
+// the lifetime of the connection, so a caller can read live
+// PingsSent/PongsRecv/IdleCloses counters - e.g. from a Prometheus
+// scrape loop - while the loop is still running instead of only after
+// ConnectToProxyWS returns. A nil stats allocates one internally that's
+// only reachable through the return value once the connection closes.
+func ConnectToProxyWS(ws *websocket.Conn, registry *HandlerRegistry, keepalive KeepaliveConfig, stats *KeepaliveStats) *KeepaliveStats {
+	if stats == nil {
+		stats = &KeepaliveStats{}
+	}
+
+	// writer serializes every write to ws: gorilla/websocket only
+	// supports one concurrent writer, and both the keepalive ping
+	// ticker and the response-forwarder goroutine below write to ws.
+	writer := &wsWriter{ws: ws}
+	if err := writer.WriteJSON(registry.Hello()); err != nil {
+		log.Errorf("Error sending hello to proxy: %v", err)
+		return stats
+	}
+
+	stop := runKeepalive(writer, keepalive, stats)
+	defer stop()
+
+	response := make(chan common.Message)
+	defer close(response)
+
+	var (
+		mu    sync.Mutex
+		conns = map[string]*connection{}
+	)
+
+	go func() {
+		for msg := range response {
+			if err := writer.WriteJSON(msg); err != nil {
+				log.Errorf("Error writing to proxy: %v", err)
+				return
+			}
+		}
+	}()
+
+	for {
+		var msg common.Message
+		if err := ws.ReadJSON(&msg); err != nil {
+			if isIdleTimeout(err) {
+				atomic.AddUint64(&stats.IdleCloses, 1)
+				log.Warnf("Backend connection to proxy idle, closing: %v", err)
+			} else {
+				log.Infof("Backend connection to proxy closed: %v", err)
+			}
+			break
+		}
+		if keepalive.ReadIdleTimeout > 0 {
+			ws.SetReadDeadline(time.Now().Add(keepalive.ReadIdleTimeout))
+		}
+
+		mu.Lock()
+		conn, ok := conns[msg.Key]
+		if !ok {
+			path := pathFromKey(msg.Key)
+			h, opts, found := registry.Get(path)
+			if !found {
+				mu.Unlock()
+				log.Errorf("No handler registered for path: %s", path)
+				continue
+			}
+			log.Debugf("Starting handler for %s (version %s)", path, opts.Version)
+			conn = &connection{incomingMessages: make(chan string)}
+			conns[msg.Key] = conn
+			go h.Handle(msg.Key, msg.Body, conn.incomingMessages, response)
+		}
+		mu.Unlock()
+
+		switch msg.Type {
+		case common.Body:
+			conn.incomingMessages <- msg.Body
+		case common.Close:
+			mu.Lock()
+			delete(conns, msg.Key)
+			mu.Unlock()
+			close(conn.incomingMessages)
+		}
+	}
+
+	mu.Lock()
+	for key, conn := range conns {
+		delete(conns, key)
+		close(conn.incomingMessages)
+	}
+	mu.Unlock()
+
+	return stats
+}
+
+// pathFromKey extracts the registered-path portion of a message key.
+// Keys are of the form "<connId>/<path>", e.g. "4a1f/v1/echo".
+func pathFromKey(key string) string {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return key
+	}
+	return fmt.Sprintf("/%s", parts[1])
+}
@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConnectToProxyWSStatsAreLiveDuringConnection proves a caller-owned
+// *KeepaliveStats passed into ConnectToProxyWS is updated while the
+// connection is still open, not only once ConnectToProxyWS returns -
+// otherwise a Prometheus scrape loop could never observe it.
+func TestConnectToProxyWSStatsAreLiveDuringConnection(t *testing.T) {
+	backendWs, proxySide, cleanup := newProxySidePair(t)
+	defer cleanup()
+
+	registry := NewHandlerRegistry()
+	stats := &KeepaliveStats{}
+
+	done := make(chan struct{})
+	go func() {
+		ConnectToProxyWS(backendWs, registry, KeepaliveConfig{
+			PingInterval:    10 * time.Millisecond,
+			ReadIdleTimeout: time.Second,
+		}, stats)
+		close(done)
+	}()
+
+	proxyWs := <-proxySide
+	defer proxyWs.Close()
+	if err := proxyWs.ReadJSON(&Hello{}); err != nil {
+		t.Fatalf("failed to read hello: %v", err)
+	}
+
+	go func() {
+		for {
+			if _, _, err := proxyWs.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if atomic.LoadUint64(&stats.PingsSent) > 0 {
+			proxyWs.Close()
+			<-done
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected stats.PingsSent to be observable before ConnectToProxyWS returned")
+}
@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/rancherio/websocket-proxy/common"
+)
+
+// recordingHandler records every messageKey it's asked to Handle, so a
+// test can assert which Handler the dispatch loop actually picked.
+type recordingHandler struct {
+	keys chan string
+}
+
+func (h *recordingHandler) Handle(messageKey string, initialMessage string, incomingMessages <-chan string, response chan<- common.Message) {
+	h.keys <- messageKey
+	for range incomingMessages {
+	}
+}
+
+// newProxySidePair starts a test server that hands back the raw
+// *websocket.Conn it accepted, so the test can drive ConnectToProxyWS
+// from one end and play the proxy role from the other.
+func newProxySidePair(t *testing.T) (backendSide *websocket.Conn, proxySide chan *websocket.Conn, cleanup func()) {
+	upgrader := websocket.Upgrader{}
+	proxySide = make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		proxySide <- conn
+	}))
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	return ws, proxySide, func() {
+		ws.Close()
+		srv.Close()
+	}
+}
+
+// TestConnectToProxyWSDispatchesThroughRegistryGet proves the dispatch
+// loop resolves handlers via registry.Get (the capability-aware lookup)
+// rather than the old identity-blind getHandler(path, handlers) path,
+// and that Hello advertises the options a caller actually registered.
+func TestConnectToProxyWSDispatchesThroughRegistryGet(t *testing.T) {
+	backendWs, proxySide, cleanup := newProxySidePair(t)
+	defer cleanup()
+
+	registry := NewHandlerRegistry()
+	h := &recordingHandler{keys: make(chan string, 1)}
+	registry.Register("/v1/logs/", h, HandlerOptions{Version: "1.2.3"})
+
+	go ConnectToProxyWS(backendWs, registry, DefaultKeepaliveConfig, nil)
+
+	proxyWs := <-proxySide
+	defer proxyWs.Close()
+
+	var hello Hello
+	if err := proxyWs.ReadJSON(&hello); err != nil {
+		t.Fatalf("failed to read hello: %v", err)
+	}
+	if opts, ok := hello.Paths["/v1/logs/"]; !ok || opts.Version != "1.2.3" {
+		t.Fatalf("expected hello to advertise registered options, got %+v", hello.Paths)
+	}
+
+	if err := proxyWs.WriteJSON(common.Message{Key: "1/v1/logs/1234", Type: common.Body, Body: "hi"}); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+
+	select {
+	case key := <-h.keys:
+		if key != "1/v1/logs/1234" {
+			t.Fatalf("unexpected message key: %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler registered via HandlerRegistry.Register was never dispatched to")
+	}
+}
@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+)
+
+// wsWriter serializes every write to a *websocket.Conn behind a single
+// mutex. gorilla/websocket only supports one concurrent writer per
+// connection; without this, the keepalive ping ticker and whatever
+// goroutine forwards application messages can interleave writes and
+// corrupt the frame stream.
+type wsWriter struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+func (w *wsWriter) WriteJSON(v interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ws.WriteJSON(v)
+}
+
+func (w *wsWriter) writePing(writeTimeout time.Duration) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if writeTimeout > 0 {
+		w.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+		defer w.ws.SetWriteDeadline(time.Time{})
+	}
+	return w.ws.WriteMessage(websocket.PingMessage, nil)
+}
+
+// KeepaliveConfig controls idle detection and ping/pong keepalive for a
+// single backend<->proxy websocket connection. Without this, a wedged
+// peer that never closes its TCP connection pins the goroutine running
+// connectToProxyWS forever.
+type KeepaliveConfig struct {
+	// ReadIdleTimeout is how long to wait for any read activity
+	// (a message, or a pong answering our ping) before treating the
+	// connection as dead and tearing it down. Zero disables idle
+	// detection.
+	ReadIdleTimeout time.Duration
+	// WriteTimeout bounds each keepalive ping write. Application
+	// messages written through wsWriter.WriteJSON get no write deadline.
+	// Zero means no deadline.
+	WriteTimeout time.Duration
+	// PingInterval is how often to send a ping frame. Should be
+	// comfortably shorter than ReadIdleTimeout so a live peer gets a
+	// chance to pong before it would be considered idle. Zero disables
+	// pinging.
+	PingInterval time.Duration
+}
+
+// DefaultKeepaliveConfig is used by connectToProxyWS, which predates
+// configurable keepalive and has no way to take one as a parameter
+// without breaking its existing callers.
+var DefaultKeepaliveConfig = KeepaliveConfig{
+	ReadIdleTimeout: 60 * time.Second,
+	WriteTimeout:    10 * time.Second,
+	PingInterval:    20 * time.Second,
+}
+
+// KeepaliveStats holds Prometheus-style counters for the ping/pong
+// activity observed on one connection. Field names match the
+// conventional counter metric names (minus the "_total" suffix) so they
+// can be registered directly against a Prometheus counter vec keyed by
+// connection.
+type KeepaliveStats struct {
+	PingsSent  uint64
+	PongsRecv  uint64
+	IdleCloses uint64
+}
+
+// runKeepalive wires ping/pong handling and idle-timeout enforcement
+// into writer's underlying connection per cfg, and returns a cleanup
+// func to stop the ping ticker. Idle detection itself happens on the
+// read side: once SetReadDeadline is armed here, a caller's blocking
+// Read/ReadJSON simply returns a net.Error with Timeout() == true if no
+// pong or message arrives in time (see isIdleTimeout). Pings are sent
+// through writer so they're serialized against any other goroutine
+// writing application messages on the same connection.
+func runKeepalive(writer *wsWriter, cfg KeepaliveConfig, stats *KeepaliveStats) (stop func()) {
+	ws := writer.ws
+	if cfg.ReadIdleTimeout > 0 {
+		ws.SetReadDeadline(time.Now().Add(cfg.ReadIdleTimeout))
+	}
+
+	ws.SetPongHandler(func(string) error {
+		atomic.AddUint64(&stats.PongsRecv, 1)
+		if cfg.ReadIdleTimeout > 0 {
+			ws.SetReadDeadline(time.Now().Add(cfg.ReadIdleTimeout))
+		}
+		return nil
+	})
+
+	done := make(chan struct{})
+	if cfg.PingInterval > 0 {
+		ticker := time.NewTicker(cfg.PingInterval)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := writer.writePing(cfg.WriteTimeout); err != nil {
+						log.Warnf("Failed to send keepalive ping: %v", err)
+						return
+					}
+					atomic.AddUint64(&stats.PingsSent, 1)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	return func() { close(done) }
+}
+
+// isIdleTimeout reports whether err is a read deadline expiring, as
+// opposed to a normal close or another I/O error.
+func isIdleTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestWSPair spins up a local websocket server that reads and
+// discards every message, and returns the client-side *websocket.Conn
+// connected to it.
+func newTestWSPair(t *testing.T) (*websocket.Conn, func()) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	}))
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	return ws, func() {
+		ws.Close()
+		srv.Close()
+	}
+}
+
+func TestWsWriterSerializesConcurrentWrites(t *testing.T) {
+	ws, cleanup := newTestWSPair(t)
+	defer cleanup()
+
+	writer := &wsWriter{ws: ws}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := writer.WriteJSON(map[string]string{"k": "v"}); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := writer.writePing(time.Second); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("concurrent write through wsWriter failed: %v", err)
+	}
+}
+
+func TestRunKeepaliveReceivesPongs(t *testing.T) {
+	ws, cleanup := newTestWSPair(t)
+	defer cleanup()
+
+	// The test server's read loop doesn't install a custom ping
+	// handler, so gorilla/websocket's default one answers our pings
+	// with a pong automatically; runKeepalive's SetPongHandler should
+	// then see it and bump PongsRecv.
+	stats := &KeepaliveStats{}
+	stop := runKeepalive(&wsWriter{ws: ws}, KeepaliveConfig{
+		PingInterval:    10 * time.Millisecond,
+		ReadIdleTimeout: time.Second,
+	}, stats)
+	defer stop()
+
+	go func() {
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if atomic.LoadUint64(&stats.PongsRecv) > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected at least one pong to be received")
+}
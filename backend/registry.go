@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"sync"
+)
+
+// Codec identifies how a Handler expects message bodies to be encoded
+// on the wire.
+type Codec string
+
+const (
+	CodecJSON    Codec = "json"
+	CodecMsgpack Codec = "msgpack"
+	CodecRaw     Codec = "raw"
+)
+
+// HandlerOptions describes the capabilities a registered Handler
+// supports, so the proxy can check a frontend request against a live
+// backend's capabilities before routing to it, instead of discovering a
+// version/codec mismatch only after the handshake.
+type HandlerOptions struct {
+	// Version is the handler's semantic version, e.g. "1.2.0". Bump the
+	// major version on breaking wire-format changes.
+	Version string
+	// Subprotocols lists the Sec-WebSocket-Protocol values this handler
+	// accepts. Empty means any subprotocol (or none) is acceptable.
+	Subprotocols []string
+	// Codec is the message encoding this handler expects. Defaults to
+	// CodecJSON if left unset.
+	Codec Codec
+}
+
+type registration struct {
+	handler Handler
+	options HandlerOptions
+}
+
+// HandlerRegistry tracks the handlers a backend process has registered
+// for its paths, along with the capabilities each was registered with.
+// Passing one into ConnectToProxyWS replaces the older bare
+// map[string]Handler entry point (connectToProxyWS): the Hello frame
+// advertises each path's real capabilities, and the dispatch loop looks
+// handlers up through Get so those capabilities are consulted on every
+// incoming message, not just at handshake time.
+//
+// NOTE: this only covers the backend side of capability negotiation -
+// the proxy package that would receive Hello and actually reject a
+// frontend request whose Sec-WebSocket-Protocol/version isn't satisfied
+// by any live backend isn't part of this checkout, so that half of the
+// request (rejecting with a proper HTTP error instead of
+// ErrBadHandshake) isn't implemented here.
+type HandlerRegistry struct {
+	mu     sync.RWMutex
+	byPath map[string]registration
+}
+
+// NewHandlerRegistry returns an empty HandlerRegistry.
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{byPath: map[string]registration{}}
+}
+
+// Register adds h under path with the given options. Registering the
+// same path twice replaces the previous registration.
+func (r *HandlerRegistry) Register(path string, h Handler, opts HandlerOptions) {
+	if opts.Codec == "" {
+		opts.Codec = CodecJSON
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byPath[path] = registration{handler: h, options: opts}
+}
+
+// handlers returns a plain map[string]Handler snapshot suitable for the
+// existing prefix-matching getHandler helper.
+func (r *HandlerRegistry) handlers() map[string]Handler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(map[string]Handler, len(r.byPath))
+	for path, reg := range r.byPath {
+		out[path] = reg.handler
+	}
+	return out
+}
+
+// Get returns the Handler registered for path along with the options it
+// was registered with, using the same prefix-matching rules as
+// getHandler. It looks the options up by the matched prefix key itself
+// rather than by Handler identity, so it can't return the wrong options
+// if the same Handler value is ever registered under two paths with
+// different HandlerOptions.
+func (r *HandlerRegistry) Get(path string) (Handler, HandlerOptions, bool) {
+	prefix, _, found := getHandlerWithPrefix(path, r.handlers())
+	if !found {
+		return nil, HandlerOptions{}, false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	reg, ok := r.byPath[prefix]
+	if !ok {
+		return nil, HandlerOptions{}, false
+	}
+	return reg.handler, reg.options, true
+}
+
+// Hello is the frame a backend sends immediately after connecting to
+// the proxy, enumerating every path it has registered and the
+// capabilities each supports, so the proxy on the other end can learn
+// them before any message is routed. Nothing in this package reads a
+// Hello or rejects requests based on it.
+type Hello struct {
+	Paths map[string]HandlerOptions `json:"paths"`
+}
+
+// Hello builds the handshake frame advertising every path currently
+// registered.
+func (r *HandlerRegistry) Hello() Hello {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	hello := Hello{Paths: make(map[string]HandlerOptions, len(r.byPath))}
+	for path, reg := range r.byPath {
+		hello.Paths[path] = reg.options
+	}
+	return hello
+}
@@ -0,0 +1,56 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/rancherio/websocket-proxy/common"
+)
+
+type stubHandler struct{}
+
+func (s *stubHandler) Handle(messageKey string, initialMessage string, incomingMessages <-chan string, response chan<- common.Message) {
+}
+
+func TestHandlerRegistryGetReturnsOptionsForMatchedPrefix(t *testing.T) {
+	r := NewHandlerRegistry()
+	h := &stubHandler{}
+
+	// The same Handler value registered under two different paths with
+	// different options - Get must key off the matched prefix, not off
+	// the Handler identity, or it can return the wrong options.
+	r.Register("/v1/logs/", h, HandlerOptions{Version: "1.0.0"})
+	r.Register("/v1/stats/", h, HandlerOptions{Version: "2.0.0"})
+
+	_, opts, ok := r.Get("/v1/logs/1234")
+	if !ok || opts.Version != "1.0.0" {
+		t.Fatalf("expected version 1.0.0 for /v1/logs/1234, got %+v (ok=%v)", opts, ok)
+	}
+
+	_, opts, ok = r.Get("/v1/stats/1234")
+	if !ok || opts.Version != "2.0.0" {
+		t.Fatalf("expected version 2.0.0 for /v1/stats/1234, got %+v (ok=%v)", opts, ok)
+	}
+}
+
+func TestHandlerRegistryGetUnknownPath(t *testing.T) {
+	r := NewHandlerRegistry()
+	r.Register("/v1/logs/", &stubHandler{}, HandlerOptions{})
+
+	if _, _, ok := r.Get("/v1/foo"); ok {
+		t.Fatal("expected no match for an unregistered path")
+	}
+}
+
+func TestHandlerRegistryHelloDefaultsCodec(t *testing.T) {
+	r := NewHandlerRegistry()
+	r.Register("/v1/logs/", &stubHandler{}, HandlerOptions{Version: "1.0.0"})
+
+	hello := r.Hello()
+	opts, ok := hello.Paths["/v1/logs/"]
+	if !ok {
+		t.Fatal("expected /v1/logs/ to be advertised in Hello")
+	}
+	if opts.Codec != CodecJSON {
+		t.Fatalf("expected Register to default Codec to CodecJSON, got %q", opts.Codec)
+	}
+}
@@ -0,0 +1,75 @@
+package proxyprotocol
+
+import (
+	"container/list"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestConnProxyInfoReturnsNilWithoutHeader(t *testing.T) {
+	conn, _ := newTestConn([]byte("GET / HTTP/1.1\r\n"))
+
+	if info := conn.ProxyInfo(); info != nil {
+		t.Fatalf("expected nil ProxyInfo for a connection with no PROXY header, got %+v", info)
+	}
+}
+
+func TestConnProxyInfoOnlyParsesOnce(t *testing.T) {
+	data := []byte("PROXY TCP4 127.0.0.1 127.0.0.2 1000 2000\r\npayload")
+	conn, _ := newTestConn(data)
+
+	first := conn.ProxyInfo()
+	second := conn.ProxyInfo()
+	if first != second {
+		t.Fatal("ProxyInfo() should return the same parsed result on repeated calls, not reparse")
+	}
+
+	buf := make([]byte, len("payload"))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "payload" {
+		t.Fatalf("Read after ProxyInfo() should still return the payload, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestInfoCacheEvictsOldestBeyondCapacity(t *testing.T) {
+	c := &infoCache{entries: make(map[string]*infoCacheEntry), order: list.New()}
+
+	for i := 0; i < infoCacheSize+10; i++ {
+		key := fmt.Sprintf("10.0.0.1:%d", i)
+		c.put(key, &ProxyProtoInfo{Protocol: "PROXY"})
+	}
+
+	if _, ok := c.get("10.0.0.1:0"); ok {
+		t.Fatal("oldest entry should have been evicted once capacity was exceeded")
+	}
+	if _, ok := c.get(fmt.Sprintf("10.0.0.1:%d", infoCacheSize+9)); !ok {
+		t.Fatal("most recently added entry should still be present")
+	}
+	if len(c.entries) != infoCacheSize {
+		t.Fatalf("cache should be bounded at %d entries, got %d", infoCacheSize, len(c.entries))
+	}
+}
+
+func TestInfoCacheExpiresByTTL(t *testing.T) {
+	c := &infoCache{entries: make(map[string]*infoCacheEntry), order: list.New()}
+	c.put("10.0.0.1:1", &ProxyProtoInfo{Protocol: "PROXY"})
+
+	// Backdate the entry instead of sleeping past infoCacheTTL.
+	c.entries["10.0.0.1:1"].addedAt = time.Now().Add(-infoCacheTTL - time.Second)
+
+	if _, ok := c.get("10.0.0.1:1"); ok {
+		t.Fatal("expired entry should not be returned")
+	}
+}
+
+func TestInfoCacheDelete(t *testing.T) {
+	c := &infoCache{entries: make(map[string]*infoCacheEntry), order: list.New()}
+	c.put("10.0.0.1:1", &ProxyProtoInfo{Protocol: "PROXY"})
+
+	c.delete("10.0.0.1:1")
+
+	if _, ok := c.get("10.0.0.1:1"); ok {
+		t.Fatal("deleted entry should not be returned")
+	}
+}
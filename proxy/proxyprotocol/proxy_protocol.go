@@ -27,6 +27,8 @@ package proxyprotocol
 import (
 	"bufio"
 	"bytes"
+	"container/list"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -38,19 +40,96 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+// infoCacheSize and infoCacheTTL bound the legacy putInfo/getInfo cache
+// below. Callers that hold on to their *Conn should prefer
+// Conn.ProxyInfo() instead, which needs no global state at all.
+const (
+	infoCacheSize = 4096
+	infoCacheTTL  = 5 * time.Minute
+)
+
 var (
 	// prefix is the string we look for at the start of a connection
-	// to check if this connection is using the proxy protocol
+	// to check if this connection is using the proxy protocol (v1)
 	prefix    = []byte("PROXY ")
 	prefixLen = len(prefix)
+
+	// sigV2 is the 12 byte signature that starts every proxy protocol
+	// v2 (binary) header.
+	sigV2 = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+	errBadV2Header = fmt.Errorf("Invalid proxy protocol v2 header")
+)
+
+// v2 address family / protocol nibbles of the 14th header byte.
+const (
+	v2AFUnspec = 0x0
+	v2AFInet   = 0x1
+	v2AFInet6  = 0x2
+	v2AFUnix   = 0x3
+
+	v2ProtoUnspec = 0x0
+	v2ProtoStream = 0x1
+	v2ProtoDgram  = 0x2
+)
+
+// v2 commands, the low nibble of the 13th header byte (the first one
+// after the signature).
+const (
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
 )
 
+const (
+	v2AddrLenInet  = 12
+	v2AddrLenInet6 = 36
+	v2AddrLenUnix  = 216
+)
+
+// Mode controls how a Listener treats the presence (or absence) of a
+// PROXY protocol header on an incoming connection.
+type Mode int
+
+const (
+	// Optional accepts connections whether or not they carry a PROXY
+	// header, trusting the header if present. This is the historical
+	// behavior and is unsafe to use unless every possible peer is
+	// trusted, since any direct client can simply omit the header to
+	// spoof its source address.
+	Optional Mode = iota
+	// Required closes any connection that does not present a valid
+	// PROXY header.
+	Required
+	// Reject only trusts a PROXY header from peers whose real TCP
+	// remote address falls within TrustedCIDRs; a header from an
+	// untrusted peer is stripped (the connection is kept, but the
+	// peer's actual address is used instead of the claimed one).
+	Reject
+)
+
+// ListenerConfig controls the PROXY protocol handling of a Listener.
+type ListenerConfig struct {
+	// Mode determines whether/when a PROXY header is required. Defaults
+	// to Optional.
+	Mode Mode
+	// TrustedCIDRs lists the networks allowed to supply a PROXY header
+	// when Mode is Reject. Ignored for the other modes.
+	TrustedCIDRs []*net.IPNet
+	// HeaderTimeout bounds how long checkPrefix will block waiting for
+	// a PROXY header before giving up and closing the connection. A
+	// zero value means no deadline is applied, which risks Accept (via
+	// the first Read/RemoteAddr call) hanging forever on a slow or
+	// malicious peer.
+	HeaderTimeout time.Duration
+}
+
 // Listener is used to wrap an underlying listener,
-// whose connections may be using the HAProxy Proxy Protocol (version 1).
-// If the connection is using the protocol, the RemoteAddr() will return
-// the correct client address.
+// whose connections may be using the HAProxy Proxy Protocol (version 1
+// or 2). If the connection is using the protocol, the RemoteAddr() will
+// return the correct client address.
 type Listener struct {
 	Listener net.Listener
+	Config   ListenerConfig
 }
 
 // Conn is used to wrap and underlying connection which
@@ -61,12 +140,39 @@ type Conn struct {
 	conn      net.Conn
 	srcAddr   *net.TCPAddr
 	once      sync.Once
+	config    ListenerConfig
+	gotHeader bool
+	info      *ProxyProtoInfo
+}
+
+// ProxyInfo returns the ProxyProtoInfo parsed from this connection's
+// PROXY header, or nil if the connection didn't carry one. It triggers
+// header parsing (via checkPrefix) on first call if that hasn't
+// happened yet, so it is safe to call before Read/RemoteAddr.
+func (p *Conn) ProxyInfo() *ProxyProtoInfo {
+	p.once.Do(func() {
+		if err := p.checkPrefix(); err != nil && err != io.EOF {
+			log.Warnf("[ERR] Failed to read proxy prefix: %v", err)
+		}
+	})
+	return p.info
 }
 
 type ProxyProtoInfo struct {
 	Protocol   string
 	ClientAddr *net.TCPAddr
 	ProxyAddr  *net.TCPAddr
+	// TLVs holds any type-length-value trailers sent with a v2 header,
+	// keyed by their type byte (e.g. PP2_TYPE_AUTHORITY, PP2_TYPE_SSL).
+	// It is nil for v1 headers, which don't support TLVs.
+	TLVs map[byte][]byte
+}
+
+// NewListener wraps an underlying net.Listener with PROXY protocol
+// support, applying the given ListenerConfig to every accepted
+// connection.
+func NewListener(l net.Listener, config ListenerConfig) *Listener {
+	return &Listener{Listener: l, Config: config}
 }
 
 // Accept waits for and returns the next connection to the listener.
@@ -76,7 +182,7 @@ func (p *Listener) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewConn(conn), nil
+	return newConnWithConfig(conn, p.Config), nil
 }
 
 // Close closes the underlying listener.
@@ -90,13 +196,34 @@ func (p *Listener) Addr() net.Addr {
 }
 
 // NewConn is used to wrap a net.Conn that may be speaking
-// the proxy protocol into a proxyproto.Conn
+// the proxy protocol into a proxyproto.Conn, in the default Optional
+// mode. Use NewListener with a ListenerConfig to enforce Required or
+// Reject semantics.
 func NewConn(conn net.Conn) *Conn {
-	pConn := &Conn{
+	return newConnWithConfig(conn, ListenerConfig{Mode: Optional})
+}
+
+func newConnWithConfig(conn net.Conn, config ListenerConfig) *Conn {
+	return &Conn{
 		bufReader: bufio.NewReader(conn),
 		conn:      conn,
+		config:    config,
+	}
+}
+
+// trustedPeer reports whether conn's real remote address falls within
+// one of the configured TrustedCIDRs.
+func trustedPeer(conn net.Conn, trusted []*net.IPNet) bool {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
 	}
-	return pConn
+	for _, cidr := range trusted {
+		if cidr.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
 }
 
 // Read is check for the proxy protocol header when doing
@@ -154,8 +281,63 @@ func (p *Conn) SetWriteDeadline(t time.Time) error {
 	return p.conn.SetWriteDeadline(t)
 }
 
+// checkPrefix peeks at (and, if present, consumes) a PROXY header, then
+// enforces the Conn's configured Mode. If HeaderTimeout is set, a read
+// deadline bounds the whole operation so a slow or malicious peer can't
+// hang Accept/Read/RemoteAddr indefinitely.
 func (p *Conn) checkPrefix() error {
-	// Incrementally check each byte of the prefix
+	if p.config.HeaderTimeout > 0 {
+		p.conn.SetReadDeadline(time.Now().Add(p.config.HeaderTimeout))
+		defer p.conn.SetReadDeadline(time.Time{})
+	}
+
+	if err := p.parseHeader(); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			p.conn.Close()
+		}
+		return err
+	}
+	return p.enforceMode()
+}
+
+// enforceMode applies the Conn's Mode now that parseHeader has run, and
+// closes the connection if the mode's requirements weren't met.
+func (p *Conn) enforceMode() error {
+	switch p.config.Mode {
+	case Required:
+		if !p.gotHeader {
+			p.conn.Close()
+			return fmt.Errorf("PROXY header required but not present")
+		}
+	case Reject:
+		if p.gotHeader && !trustedPeer(p.conn, p.config.TrustedCIDRs) {
+			// Untrusted peer claiming a source address: drop the
+			// claim entirely, including the info exposed via
+			// ProxyInfo()/getInfo, not just srcAddr. Otherwise a
+			// caller that trusts ProxyInfo() (e.g. to read the
+			// PP2_TYPE_AUTHORITY/SNI TLV) still sees the spoofed
+			// identity even though RemoteAddr() is correct.
+			if p.info != nil && p.info.ClientAddr != nil {
+				globalInfoCache.delete(p.info.ClientAddr.String())
+			}
+			p.srcAddr = nil
+			p.info = nil
+		}
+	}
+	return nil
+}
+
+func (p *Conn) parseHeader() error {
+	// Peek enough bytes to check for the v2 (binary) signature first,
+	// since it can't be distinguished from v1 by looking at a single
+	// leading byte.
+	sig, err := p.bufReader.Peek(len(sigV2))
+	if err == nil && bytes.Equal(sig, sigV2) {
+		p.gotHeader = true
+		return p.parseV2Header()
+	}
+
+	// Incrementally check each byte of the v1 prefix
 	for i := 1; i <= prefixLen; i++ {
 		inp, err := p.bufReader.Peek(i)
 		if err != nil {
@@ -167,6 +349,7 @@ func (p *Conn) checkPrefix() error {
 			return nil
 		}
 	}
+	p.gotHeader = true
 
 	// Read the header line
 	header, err := p.bufReader.ReadString('\n')
@@ -225,7 +408,255 @@ func (p *Conn) checkPrefix() error {
 		ClientAddr: p.srcAddr,
 		ProxyAddr:  destAddr,
 	}
+	p.info = proxyInfo
 	putInfo(proxyInfo.ClientAddr.String(), proxyInfo)
 
 	return nil
 }
+
+// parseV2Header parses a binary (v2) PROXY protocol header. The 12 byte
+// signature has already been peeked (but not consumed) by parseHeader.
+//
+// Layout: 12 byte signature, 1 byte version/command, 1 byte address
+// family/protocol, 2 byte big-endian length, followed by `length` bytes
+// of address block + TLVs.
+func (p *Conn) parseV2Header() error {
+	header, err := p.bufReader.Peek(len(sigV2) + 4)
+	if err != nil {
+		p.conn.Close()
+		return errBadV2Header
+	}
+
+	verCmd := header[12]
+	version := verCmd >> 4
+	cmd := verCmd & 0x0F
+	if version != 2 {
+		p.conn.Close()
+		return fmt.Errorf("Unsupported proxy protocol version: %d", version)
+	}
+
+	famProto := header[13]
+	family := famProto >> 4
+	proto := famProto & 0x0F
+
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	// Consume the signature + fixed header now that we know how much
+	// more to read.
+	if _, err := p.bufReader.Discard(len(sigV2) + 4); err != nil {
+		p.conn.Close()
+		return err
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(p.bufReader, body); err != nil {
+		p.conn.Close()
+		return err
+	}
+
+	// LOCAL connections (e.g. health checks from the proxy itself) carry
+	// no meaningful source - leave srcAddr unset so RemoteAddr() falls
+	// back to the real peer address.
+	if cmd == v2CmdLocal {
+		return nil
+	}
+	if cmd != v2CmdProxy {
+		p.conn.Close()
+		return fmt.Errorf("Unhandled proxy protocol v2 command: %#x", cmd)
+	}
+
+	var addrLen int
+	switch family {
+	case v2AFInet:
+		addrLen = v2AddrLenInet
+	case v2AFInet6:
+		addrLen = v2AddrLenInet6
+	case v2AFUnix:
+		addrLen = v2AddrLenUnix
+	case v2AFUnspec:
+		// No address information, e.g. proxies doing local health
+		// checks. Nothing more to do.
+		return nil
+	default:
+		p.conn.Close()
+		return fmt.Errorf("Unhandled proxy protocol v2 address family: %#x", family)
+	}
+
+	if proto != v2ProtoStream && proto != v2ProtoDgram {
+		p.conn.Close()
+		return fmt.Errorf("Unhandled proxy protocol v2 protocol: %#x", proto)
+	}
+
+	if len(body) < addrLen {
+		p.conn.Close()
+		return fmt.Errorf("Truncated proxy protocol v2 address block")
+	}
+
+	// AF_UNIX addresses (two 108 byte socket paths) don't fit net.TCPAddr
+	// and carry no port; leave srcAddr/dstAddr nil so RemoteAddr() falls
+	// back to the real peer address, but still parse the TLV trailer.
+	var srcAddr, dstAddr *net.TCPAddr
+	if family != v2AFUnix {
+		srcAddr, dstAddr, err = parseV2Addrs(family, body[:addrLen])
+		if err != nil {
+			p.conn.Close()
+			return err
+		}
+		p.srcAddr = srcAddr
+	}
+
+	tlvs, err := parseV2TLVs(body[addrLen:])
+	if err != nil {
+		p.conn.Close()
+		return err
+	}
+
+	proxyInfo := &ProxyProtoInfo{
+		Protocol:   "PROXY2",
+		ClientAddr: p.srcAddr,
+		ProxyAddr:  dstAddr,
+		TLVs:       tlvs,
+	}
+	p.info = proxyInfo
+	// AF_UNIX leaves ClientAddr nil; there's no meaningful key to cache
+	// it under in the legacy address-keyed map.
+	if proxyInfo.ClientAddr != nil {
+		putInfo(proxyInfo.ClientAddr.String(), proxyInfo)
+	}
+
+	return nil
+}
+
+// parseV2Addrs decodes the fixed-size address block of a v2 header into
+// source and destination TCP addresses. Only called for INET/INET6;
+// AF_UNIX is handled by the caller since it has no TCPAddr equivalent.
+func parseV2Addrs(family byte, addr []byte) (src, dst *net.TCPAddr, err error) {
+	switch family {
+	case v2AFInet:
+		srcIP := net.IP(addr[0:4])
+		dstIP := net.IP(addr[4:8])
+		srcPort := binary.BigEndian.Uint16(addr[8:10])
+		dstPort := binary.BigEndian.Uint16(addr[10:12])
+		return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+			&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+	case v2AFInet6:
+		srcIP := net.IP(addr[0:16])
+		dstIP := net.IP(addr[16:32])
+		srcPort := binary.BigEndian.Uint16(addr[32:34])
+		dstPort := binary.BigEndian.Uint16(addr[34:36])
+		return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+			&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+	default:
+		return nil, nil, fmt.Errorf("Unsupported address family for address parsing: %#x", family)
+	}
+}
+
+// parseV2TLVs walks a sequence of type-length-value trailers (such as
+// PP2_TYPE_AUTHORITY or PP2_TYPE_SSL) and returns them keyed by type.
+func parseV2TLVs(b []byte) (map[byte][]byte, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	tlvs := map[byte][]byte{}
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("Truncated proxy protocol v2 TLV")
+		}
+		t := b[0]
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		b = b[3:]
+		if len(b) < l {
+			return nil, fmt.Errorf("Truncated proxy protocol v2 TLV value")
+		}
+		tlvs[t] = b[:l]
+		b = b[l:]
+	}
+	return tlvs, nil
+}
+
+// infoCacheEntry is the value type stored in infoCache.entries, keeping
+// the insertion time alongside the info so expired entries can be
+// evicted lazily.
+type infoCacheEntry struct {
+	info    *ProxyProtoInfo
+	addedAt time.Time
+	elem    *list.Element
+}
+
+// infoCache is a bounded, TTL-expiring LRU cache. It exists purely to
+// keep the legacy putInfo/getInfo package-level functions below from
+// growing without bound; new code should call Conn.ProxyInfo() instead,
+// which doesn't need a global map keyed by address at all.
+type infoCache struct {
+	mu      sync.Mutex
+	entries map[string]*infoCacheEntry
+	order   *list.List // front = most recently used
+}
+
+var globalInfoCache = &infoCache{
+	entries: make(map[string]*infoCacheEntry),
+	order:   list.New(),
+}
+
+func (c *infoCache) put(key string, info *ProxyProtoInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, ok := c.entries[key]; ok {
+		c.order.Remove(existing.elem)
+	}
+
+	elem := c.order.PushFront(key)
+	c.entries[key] = &infoCacheEntry{info: info, addedAt: time.Now(), elem: elem}
+
+	for len(c.entries) > infoCacheSize {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(string))
+	}
+}
+
+func (c *infoCache) get(key string) (*ProxyProtoInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(entry.addedAt) > infoCacheTTL {
+		c.order.Remove(entry.elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(entry.elem)
+	return entry.info, true
+}
+
+func (c *infoCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.order.Remove(entry.elem)
+	delete(c.entries, key)
+}
+
+// putInfo and getInfo are kept for backward compatibility with callers
+// that look up ProxyProtoInfo by stringified client address rather than
+// by holding on to the *Conn. Prefer Conn.ProxyInfo(): it can't race
+// across goroutines sharing a client IP, and needs no eviction policy.
+func putInfo(key string, info *ProxyProtoInfo) {
+	globalInfoCache.put(key, info)
+}
+
+func getInfo(key string) (*ProxyProtoInfo, bool) {
+	return globalInfoCache.get(key)
+}
@@ -0,0 +1,155 @@
+package proxyprotocol
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestConnWithConfig(data []byte, config ListenerConfig) (*Conn, *fakeConn) {
+	fc := &fakeConn{r: bytes.NewReader(data)}
+	return newConnWithConfig(fc, config), fc
+}
+
+// timeoutError satisfies net.Error with Timeout() == true, the same
+// shape *net.OpError reports for an expired deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadlineConn extends fakeConn with a SetReadDeadline that's actually
+// honored: once armed, Read blocks until the deadline (simulating a
+// peer that never sends anything) and then returns timeoutError,
+// instead of fakeConn's no-op stub which can't prove HeaderTimeout does
+// anything. A peer that has data buffered already reads normally,
+// regardless of the deadline, so a fast header doesn't pay for the
+// whole timeout.
+type deadlineConn struct {
+	fakeConn
+	deadline time.Time
+	armed    bool
+}
+
+func (d *deadlineConn) SetReadDeadline(t time.Time) error {
+	d.deadline = t
+	if !t.IsZero() {
+		d.armed = true
+	}
+	return nil
+}
+
+func (d *deadlineConn) Read(b []byte) (int, error) {
+	if d.r.Len() == 0 && !d.deadline.IsZero() {
+		if wait := time.Until(d.deadline); wait > 0 {
+			time.Sleep(wait)
+		}
+		return 0, timeoutError{}
+	}
+	return d.fakeConn.Read(b)
+}
+
+func newTestDeadlineConnWithConfig(data []byte, config ListenerConfig) (*Conn, *deadlineConn) {
+	dc := &deadlineConn{fakeConn: fakeConn{r: bytes.NewReader(data)}}
+	return newConnWithConfig(dc, config), dc
+}
+
+func TestRequiredModeClosesWithoutHeader(t *testing.T) {
+	conn, fc := newTestConnWithConfig([]byte("not a proxy header"), ListenerConfig{Mode: Required})
+
+	if err := conn.checkPrefix(); err == nil {
+		t.Fatal("expected Required mode to reject a connection with no PROXY header")
+	}
+	if !fc.closed {
+		t.Fatal("Required mode should close the connection when no header is present")
+	}
+}
+
+func TestRequiredModeAllowsValidHeader(t *testing.T) {
+	data := []byte("PROXY TCP4 127.0.0.1 127.0.0.2 1000 2000\r\n")
+	conn, fc := newTestConnWithConfig(data, ListenerConfig{Mode: Required})
+
+	if err := conn.checkPrefix(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fc.closed {
+		t.Fatal("Required mode should not close a connection with a valid header")
+	}
+}
+
+func TestRejectModeStripsUntrustedHeaderEverywhere(t *testing.T) {
+	_, trustedCIDR, _ := net.ParseCIDR("192.168.0.0/16")
+	data := []byte("PROXY TCP4 10.1.1.1 10.1.1.2 1000 2000\r\n")
+	// fakeConn.RemoteAddr() is fixed at 10.0.0.2, which is outside
+	// trustedCIDR, so the header above should be treated as spoofed.
+	conn, fc := newTestConnWithConfig(data, ListenerConfig{
+		Mode:         Reject,
+		TrustedCIDRs: []*net.IPNet{trustedCIDR},
+	})
+
+	ra := conn.RemoteAddr().(*net.TCPAddr)
+	if ra.IP.String() != "10.0.0.2" {
+		t.Fatalf("RemoteAddr should fall back to the real peer, got %v", ra)
+	}
+	if info := conn.ProxyInfo(); info != nil {
+		t.Fatalf("ProxyInfo() should not expose the spoofed header from an untrusted peer, got %+v", info)
+	}
+	if fc.closed {
+		t.Fatal("Reject mode should not close the connection, only strip the claim")
+	}
+
+	if info, ok := getInfo("10.1.1.1:1000"); ok {
+		t.Fatalf("legacy getInfo cache should not retain the spoofed claim either, got %+v", info)
+	}
+}
+
+func TestRejectModeKeepsTrustedHeader(t *testing.T) {
+	_, trustedCIDR, _ := net.ParseCIDR("10.0.0.0/8")
+	data := []byte("PROXY TCP4 10.1.1.1 10.1.1.2 1000 2000\r\n")
+	conn, _ := newTestConnWithConfig(data, ListenerConfig{
+		Mode:         Reject,
+		TrustedCIDRs: []*net.IPNet{trustedCIDR},
+	})
+
+	info := conn.ProxyInfo()
+	if info == nil || info.ClientAddr.IP.String() != "10.1.1.1" {
+		t.Fatalf("Reject mode should keep the header from a trusted peer, got %+v", info)
+	}
+}
+
+func TestHeaderTimeoutCutsOffSlowPeer(t *testing.T) {
+	conn, dc := newTestDeadlineConnWithConfig(nil, ListenerConfig{HeaderTimeout: 20 * time.Millisecond})
+
+	start := time.Now()
+	err := conn.checkPrefix()
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("expected checkPrefix to fail for a peer that never sends a header")
+	}
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		t.Fatalf("expected a net.Error with Timeout() == true, got %v (%T)", err, err)
+	}
+	if elapsed < 20*time.Millisecond {
+		t.Fatalf("expected checkPrefix to wait out the full HeaderTimeout, only waited %v", elapsed)
+	}
+	if !dc.armed {
+		t.Fatal("expected checkPrefix to have armed a read deadline on the underlying conn")
+	}
+}
+
+func TestHeaderTimeoutDoesNotDelayAFastPeer(t *testing.T) {
+	data := []byte("PROXY TCP4 127.0.0.1 127.0.0.2 1000 2000\r\n")
+	conn, _ := newTestDeadlineConnWithConfig(data, ListenerConfig{HeaderTimeout: time.Hour})
+
+	start := time.Now()
+	if err := conn.checkPrefix(); err != nil {
+		t.Fatalf("unexpected error for a peer that sends its header immediately: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("a header that's already buffered shouldn't wait anywhere near HeaderTimeout, took %v", elapsed)
+	}
+}
@@ -0,0 +1,217 @@
+package proxyprotocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn backed by an in-memory buffer, enough
+// to drive Conn.checkPrefix without a real socket.
+type fakeConn struct {
+	r      *bytes.Reader
+	closed bool
+}
+
+func (f *fakeConn) Read(b []byte) (int, error)  { return f.r.Read(b) }
+func (f *fakeConn) Write(b []byte) (int, error) { return len(b), nil }
+func (f *fakeConn) Close() error                { f.closed = true; return nil }
+func (f *fakeConn) LocalAddr() net.Addr         { return &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9} }
+func (f *fakeConn) RemoteAddr() net.Addr        { return &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 8} }
+func (f *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (f *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (f *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newTestConn(data []byte) (*Conn, *fakeConn) {
+	fc := &fakeConn{r: bytes.NewReader(data)}
+	return NewConn(fc), fc
+}
+
+func v2Header(cmd, family, proto byte, body []byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(sigV2)
+	buf.WriteByte(0x20 | cmd) // version 2, command
+	buf.WriteByte(family<<4 | proto)
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(body)))
+	buf.Write(lenBuf)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func inetBody(srcIP, dstIP string, srcPort, dstPort uint16) []byte {
+	body := make([]byte, v2AddrLenInet)
+	copy(body[0:4], net.ParseIP(srcIP).To4())
+	copy(body[4:8], net.ParseIP(dstIP).To4())
+	binary.BigEndian.PutUint16(body[8:10], srcPort)
+	binary.BigEndian.PutUint16(body[10:12], dstPort)
+	return body
+}
+
+func TestParseV2HeaderInet(t *testing.T) {
+	data := v2Header(v2CmdProxy, v2AFInet, v2ProtoStream, inetBody("192.168.1.1", "192.168.1.2", 1000, 2000))
+	conn, _ := newTestConn(data)
+
+	info := conn.ProxyInfo()
+	if info == nil {
+		t.Fatal("expected non-nil ProxyInfo")
+	}
+	if info.ClientAddr.IP.String() != "192.168.1.1" || info.ClientAddr.Port != 1000 {
+		t.Fatalf("unexpected ClientAddr: %+v", info.ClientAddr)
+	}
+	if info.ProxyAddr.IP.String() != "192.168.1.2" || info.ProxyAddr.Port != 2000 {
+		t.Fatalf("unexpected ProxyAddr: %+v", info.ProxyAddr)
+	}
+	if ra := conn.RemoteAddr().(*net.TCPAddr); ra.IP.String() != "192.168.1.1" {
+		t.Fatalf("RemoteAddr should reflect the v2 source, got %v", ra)
+	}
+}
+
+func TestParseV2HeaderLocal(t *testing.T) {
+	data := v2Header(v2CmdLocal, v2AFUnspec, v2ProtoUnspec, nil)
+	conn, fc := newTestConn(data)
+
+	info := conn.ProxyInfo()
+	if info != nil {
+		t.Fatalf("LOCAL command should not populate ProxyInfo, got %+v", info)
+	}
+	if ra := conn.RemoteAddr().(*net.TCPAddr); ra.IP.String() != "10.0.0.2" {
+		t.Fatalf("RemoteAddr should fall back to the real peer, got %v", ra)
+	}
+	if fc.closed {
+		t.Fatal("a valid LOCAL header should not close the connection")
+	}
+}
+
+func TestParseV2HeaderUnixLeavesAddrNilButKeepsTLVs(t *testing.T) {
+	tlv := append([]byte{0x02, 0x00, 0x03}, []byte("abc")...) // type 0x02, len 3
+	body := append(make([]byte, v2AddrLenUnix), tlv...)
+	data := v2Header(v2CmdProxy, v2AFUnix, v2ProtoStream, body)
+	conn, fc := newTestConn(data)
+
+	info := conn.ProxyInfo()
+	if info == nil {
+		t.Fatal("expected non-nil ProxyInfo for AF_UNIX so TLVs are still reachable")
+	}
+	if info.ClientAddr != nil || info.ProxyAddr != nil {
+		t.Fatalf("AF_UNIX has no TCPAddr equivalent, want nil addrs, got %+v / %+v", info.ClientAddr, info.ProxyAddr)
+	}
+	if string(info.TLVs[0x02]) != "abc" {
+		t.Fatalf("expected TLV 0x02 = \"abc\", got %+v", info.TLVs)
+	}
+	if fc.closed {
+		t.Fatal("a valid AF_UNIX header should not close the connection")
+	}
+}
+
+func TestParseV2HeaderUnknownVersion(t *testing.T) {
+	data := v2Header(0, v2AFInet, v2ProtoStream, inetBody("1.2.3.4", "1.2.3.5", 1, 2))
+	data[12] = 0x10 // version 1, not 2 - still under the v2 signature
+	conn, fc := newTestConn(data)
+
+	if err := conn.checkPrefix(); err == nil {
+		t.Fatal("expected an error for an unsupported proxy protocol version")
+	}
+	if !fc.closed {
+		t.Fatal("connection should be closed on an unsupported version")
+	}
+}
+
+func TestParseV2HeaderUnknownFamily(t *testing.T) {
+	data := v2Header(v2CmdProxy, 0xF, v2ProtoStream, make([]byte, 4))
+	conn, fc := newTestConn(data)
+
+	if err := conn.checkPrefix(); err == nil {
+		t.Fatal("expected an error for an unhandled address family")
+	}
+	if !fc.closed {
+		t.Fatal("connection should be closed on an unhandled address family")
+	}
+}
+
+func TestParseV2TLVs(t *testing.T) {
+	cases := []struct {
+		name    string
+		input   []byte
+		want    map[byte][]byte
+		wantErr bool
+	}{
+		{name: "empty", input: nil, want: nil},
+		{
+			name:  "single",
+			input: []byte{0x01, 0x00, 0x02, 'h', 'i'},
+			want:  map[byte][]byte{0x01: []byte("hi")},
+		},
+		{
+			name: "multiple",
+			input: append(
+				[]byte{0x01, 0x00, 0x01, 'a'},
+				[]byte{0x02, 0x00, 0x02, 'b', 'c'}...,
+			),
+			want: map[byte][]byte{0x01: []byte("a"), 0x02: []byte("bc")},
+		},
+		{name: "truncated type/length", input: []byte{0x01, 0x00}, wantErr: true},
+		{name: "truncated value", input: []byte{0x01, 0x00, 0x05, 'x'}, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseV2TLVs(c.input)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("got %+v, want %+v", got, c.want)
+			}
+			for k, v := range c.want {
+				if !bytes.Equal(got[k], v) {
+					t.Fatalf("key %#x: got %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseV2Addrs(t *testing.T) {
+	src, dst, err := parseV2Addrs(v2AFInet, inetBody("1.1.1.1", "2.2.2.2", 10, 20))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if src.IP.String() != "1.1.1.1" || src.Port != 10 {
+		t.Fatalf("unexpected src: %+v", src)
+	}
+	if dst.IP.String() != "2.2.2.2" || dst.Port != 20 {
+		t.Fatalf("unexpected dst: %+v", dst)
+	}
+
+	if _, _, err := parseV2Addrs(v2AFUnix, make([]byte, v2AddrLenUnix)); err == nil {
+		t.Fatal("parseV2Addrs should not claim to support AF_UNIX")
+	}
+}
+
+func TestCheckPrefixV1StillWorks(t *testing.T) {
+	data := []byte("PROXY TCP4 127.0.0.1 127.0.0.2 1000 2000\r\nhello")
+	conn, _ := newTestConn(data)
+
+	info := conn.ProxyInfo()
+	if info == nil {
+		t.Fatal("expected non-nil ProxyInfo")
+	}
+	if info.ClientAddr.IP.String() != "127.0.0.1" || info.ClientAddr.Port != 1000 {
+		t.Fatalf("unexpected ClientAddr: %+v", info.ClientAddr)
+	}
+
+	buf := make([]byte, 5)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read should return the payload after the header, got %q, %v", buf[:n], err)
+	}
+}